@@ -21,9 +21,10 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
-	etcd "go.etcd.io/etcd/client/v2"
+	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/skydive-project/skydive/graffiti/logging"
 )
@@ -33,6 +34,14 @@ const (
 	DefaultTimeout = 5 * time.Second
 	DefaultPort    = 12379
 	DefaultServer  = "127.0.0.1"
+
+	// DefaultDetectHealthyInterval is the default period between two
+	// liveness checks of the etcd cluster.
+	DefaultDetectHealthyInterval = 10 * time.Second
+	// DefaultWatchLoopUnhealthyTimeout is the default duration without a
+	// successful liveness check after which the client is considered
+	// unhealthy.
+	DefaultWatchLoopUnhealthyTimeout = 60 * time.Second
 )
 
 // MasterElectionListener describes the multi election mechanism
@@ -41,6 +50,12 @@ type MasterElectionListener interface {
 	OnStartAsSlave()
 	OnSwitchToMaster()
 	OnSwitchToSlave()
+	// OnUnhealthy is called when the etcd client has not observed a
+	// successful request for longer than WatchLoopUnhealthyTimeout.
+	OnUnhealthy()
+	// OnRecovered is called once the client has successfully talked to
+	// the cluster again after being reported unhealthy.
+	OnRecovered()
 }
 
 // MasterElection describes the master election mechanism
@@ -51,6 +66,10 @@ type MasterElection interface {
 	IsMaster() bool
 	AddEventListener(listener MasterElectionListener)
 	TTL() time.Duration
+	// Resign gives up leadership, if held, without stopping the election.
+	// It allows a master to step down in a controlled way so that a peer
+	// can take over without waiting for the lease to expire.
+	Resign(ctx context.Context) error
 }
 
 // MasterElectionService describes the election service mechanism
@@ -60,10 +79,21 @@ type MasterElectionService interface {
 
 // Client describes a ETCD configuration client
 type Client struct {
-	id      string
-	client  *etcd.Client
-	KeysAPI etcd.KeysAPI
-	logger  logging.Logger
+	id     string
+	client *clientv3.Client
+	KV     clientv3.KV
+	logger logging.Logger
+
+	detectHealthyInterval     time.Duration
+	watchLoopUnhealthyTimeout time.Duration
+
+	healthMu        sync.Mutex
+	lastHealthyTime time.Time
+	unhealthy       bool
+	stopHealth      chan struct{}
+
+	electorsMu sync.Mutex
+	electors   []*MasterElector
 }
 
 // Opts describes the options of an etcd client
@@ -71,20 +101,31 @@ type Opts struct {
 	Servers []string
 	Timeout time.Duration
 	Logger  logging.Logger
+
+	// DetectHealthyInterval is the period at which the client probes the
+	// etcd cluster. Defaults to DefaultDetectHealthyInterval.
+	DetectHealthyInterval time.Duration
+	// WatchLoopUnhealthyTimeout is how long the client tolerates not
+	// having a successful probe before considering the connection
+	// unhealthy. Defaults to DefaultWatchLoopUnhealthyTimeout.
+	WatchLoopUnhealthyTimeout time.Duration
 }
 
 // GetInt64 returns an int64 value from the configuration key
 func (client *Client) GetInt64(key string) (int64, error) {
-	resp, err := client.KeysAPI.Get(context.Background(), key, nil)
+	resp, err := client.KV.Get(context.Background(), key)
 	if err != nil {
 		return 0, err
 	}
-	return strconv.ParseInt(resp.Node.Value, 10, 64)
+	if len(resp.Kvs) == 0 {
+		return 0, fmt.Errorf("Key %s not found", key)
+	}
+	return strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
 }
 
 // SetInt64 set an int64 value to the configuration key
 func (client *Client) SetInt64(key string, value int64) error {
-	_, err := client.KeysAPI.Set(context.Background(), key, strconv.FormatInt(value, 10), nil)
+	_, err := client.KV.Put(context.Background(), key, strconv.FormatInt(value, 10))
 	return err
 }
 
@@ -103,11 +144,8 @@ func (client *Client) Start() {
 
 // Stop the client
 func (client *Client) Stop() {
-	if tr, ok := etcd.DefaultTransport.(interface {
-		CloseIdleConnections()
-	}); ok {
-		tr.CloseIdleConnections()
-	}
+	client.stopHealthDetector()
+	client.client.Close()
 }
 
 // NewElection creates a new ETCD master elector
@@ -129,23 +167,36 @@ func NewClient(id string, opts Opts) (*Client, error) {
 		opts.Logger = logging.GetLogger()
 	}
 
-	cfg := etcd.Config{
-		Endpoints:               opts.Servers,
-		Transport:               etcd.DefaultTransport,
-		HeaderTimeoutPerRequest: opts.Timeout,
+	if opts.DetectHealthyInterval == 0 {
+		opts.DetectHealthyInterval = DefaultDetectHealthyInterval
 	}
 
-	client, err := etcd.New(cfg)
+	if opts.WatchLoopUnhealthyTimeout == 0 {
+		opts.WatchLoopUnhealthyTimeout = DefaultWatchLoopUnhealthyTimeout
+	}
+
+	cfg := clientv3.Config{
+		Endpoints:   opts.Servers,
+		DialTimeout: opts.Timeout,
+	}
+
+	cli, err := clientv3.New(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to connect to etcd: %s", err)
 	}
 
-	kapi := etcd.NewKeysAPI(client)
+	client := &Client{
+		id:                        id,
+		client:                    cli,
+		KV:                        clientv3.NewKV(cli),
+		logger:                    opts.Logger,
+		detectHealthyInterval:     opts.DetectHealthyInterval,
+		watchLoopUnhealthyTimeout: opts.WatchLoopUnhealthyTimeout,
+		lastHealthyTime:           time.Now(),
+		stopHealth:                make(chan struct{}),
+	}
+
+	client.startHealthDetector()
 
-	return &Client{
-		id:      id,
-		client:  &client,
-		KeysAPI: kapi,
-		logger:  opts.Logger,
-	}, nil
+	return client, nil
 }
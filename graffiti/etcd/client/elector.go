@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/skydive-project/skydive/graffiti/logging"
+)
+
+// DefaultSessionTTL is the lease TTL, in seconds, used for the election
+// session.
+const DefaultSessionTTL = 10
+
+// election abstracts the subset of *concurrency.Election MasterElector
+// drives, so that tests can substitute a fake instead of talking to a real
+// etcd cluster.
+type election interface {
+	Campaign(ctx context.Context, val string) error
+	Observe(ctx context.Context) <-chan clientv3.GetResponse
+	Resign(ctx context.Context) error
+}
+
+// MasterElector implements MasterElection on top of the etcd v3
+// clientv3/concurrency primitives. Leadership is backed by a lease: the
+// elected master holds the lease alive through the session's keep-alive
+// loop, and loses it (triggering a new election) as soon as the process
+// dies or the connection to etcd is lost for longer than the session TTL.
+type MasterElector struct {
+	sync.RWMutex
+	client    *Client
+	path      string
+	ttl       time.Duration
+	session   *concurrency.Session
+	election  election
+	listeners []MasterElectionListener
+	isMaster  bool
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	logger    logging.Logger
+}
+
+// NewMasterElector creates a new master elector using the given ETCD client
+// and election path
+func NewMasterElector(client *Client, path string) *MasterElector {
+	return &MasterElector{
+		client: client,
+		path:   path,
+		ttl:    DefaultSessionTTL * time.Second,
+		logger: client.logger,
+	}
+}
+
+// TTL returns the TTL of the election session
+func (e *MasterElector) TTL() time.Duration {
+	return e.ttl
+}
+
+// AddEventListener registers a new listener for election events
+func (e *MasterElector) AddEventListener(listener MasterElectionListener) {
+	e.Lock()
+	defer e.Unlock()
+	e.listeners = append(e.listeners, listener)
+}
+
+func (e *MasterElector) notifyStartAs(isMaster bool) {
+	e.RLock()
+	defer e.RUnlock()
+	for _, listener := range e.listeners {
+		if isMaster {
+			listener.OnStartAsMaster()
+		} else {
+			listener.OnStartAsSlave()
+		}
+	}
+}
+
+func (e *MasterElector) notifySwitchTo(isMaster bool) {
+	e.RLock()
+	defer e.RUnlock()
+	for _, listener := range e.listeners {
+		if isMaster {
+			listener.OnSwitchToMaster()
+		} else {
+			listener.OnSwitchToSlave()
+		}
+	}
+}
+
+// notifyUnhealthy is called by the client's watch-loop health detector when
+// it has not observed a successful request for longer than
+// WatchLoopUnhealthyTimeout.
+func (e *MasterElector) notifyUnhealthy() {
+	e.RLock()
+	defer e.RUnlock()
+	for _, listener := range e.listeners {
+		listener.OnUnhealthy()
+	}
+}
+
+// notifyRecovered is called by the client's watch-loop health detector
+// once a probe succeeds again after the elector was reported unhealthy.
+func (e *MasterElector) notifyRecovered() {
+	e.RLock()
+	defer e.RUnlock()
+	for _, listener := range e.listeners {
+		listener.OnRecovered()
+	}
+}
+
+// stopCampaign cancels the running election goroutines, waits for them to
+// actually finish, and closes the session. It is shared by Stop (final
+// teardown) and rebuildSession (teardown before a fresh session is
+// created), so that neither one can race a still-running Campaign
+// goroutine past session/election replacement.
+func (e *MasterElector) stopCampaign() {
+	e.Lock()
+	cancel := e.cancel
+	session := e.session
+	e.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	e.wg.Wait()
+
+	if session != nil {
+		session.Close()
+	}
+}
+
+// rebuildSession tears down the current session/election and creates a
+// fresh one. It is invoked by the client's watch-loop health detector when
+// the connection to etcd appears wedged, so that a hung TCP connection
+// does not leave the elector campaigning on a lease nobody is renewing.
+func (e *MasterElector) rebuildSession() {
+	e.logger.Warningf("Rebuilding election session %s after unhealthy watch loop", e.path)
+
+	e.stopCampaign()
+	e.setMaster(false)
+	e.Start()
+}
+
+func (e *MasterElector) setMaster(isMaster bool) {
+	e.Lock()
+	changed := e.isMaster != isMaster
+	e.isMaster = isMaster
+	e.Unlock()
+
+	if changed {
+		e.notifySwitchTo(isMaster)
+	}
+}
+
+// IsMaster returns true if the current instance is master
+func (e *MasterElector) IsMaster() bool {
+	e.RLock()
+	defer e.RUnlock()
+	return e.isMaster
+}
+
+// run campaigns for leadership and observes the election until the
+// election is stopped
+func (e *MasterElector) run(ctx context.Context) {
+	defer e.wg.Done()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		if err := e.election.Campaign(ctx, e.client.id); err != nil {
+			if err != context.Canceled {
+				e.logger.Errorf("Failed to campaign for election %s: %s", e.path, err)
+			}
+			return
+		}
+		e.setMaster(true)
+	}()
+
+	ch := e.election.Observe(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case resp, ok := <-ch:
+			if !ok {
+				return
+			}
+			if len(resp.Kvs) == 0 {
+				continue
+			}
+			e.setMaster(string(resp.Kvs[0].Value) == e.client.id)
+		}
+	}
+}
+
+// Start starts the election campaign in background
+func (e *MasterElector) Start() {
+	session, err := concurrency.NewSession(e.client.client, concurrency.WithTTL(int(e.ttl.Seconds())))
+	if err != nil {
+		e.logger.Errorf("Failed to create election session %s: %s", e.path, err)
+		return
+	}
+
+	e.Lock()
+	e.session = session
+	e.election = concurrency.NewElection(session, e.path)
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.Unlock()
+
+	e.client.registerElector(e)
+
+	e.notifyStartAs(false)
+
+	e.wg.Add(1)
+	go e.run(ctx)
+}
+
+// StartAndWait starts the election campaign and waits until the instance
+// becomes master
+func (e *MasterElector) StartAndWait() {
+	e.Start()
+	for !e.IsMaster() {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Resign gives up leadership, if held, without stopping the election so
+// that a new master can be elected while this instance keeps running
+func (e *MasterElector) Resign(ctx context.Context) error {
+	e.RLock()
+	election := e.election
+	e.RUnlock()
+
+	if election == nil {
+		return nil
+	}
+
+	if err := election.Resign(ctx); err != nil {
+		return err
+	}
+
+	e.setMaster(false)
+	return nil
+}
+
+// Stop stops the election and closes the underlying session
+func (e *MasterElector) Stop() {
+	e.stopCampaign()
+}
+
+var _ MasterElection = (*MasterElector)(nil)
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/skydive-project/skydive/graffiti/logging"
+)
+
+// fakeElection is an election backed by nothing but test expectations,
+// standing in for *concurrency.Election so MasterElector.Resign can be
+// exercised without a real etcd cluster.
+type fakeElection struct {
+	resignErr error
+	resigned  bool
+}
+
+func (f *fakeElection) Campaign(ctx context.Context, val string) error { return nil }
+
+func (f *fakeElection) Observe(ctx context.Context) <-chan clientv3.GetResponse { return nil }
+
+func (f *fakeElection) Resign(ctx context.Context) error {
+	f.resigned = true
+	return f.resignErr
+}
+
+// fakeListener records the MasterElectionListener callbacks it receives.
+type fakeListener struct {
+	switchedToSlave bool
+}
+
+func (l *fakeListener) OnStartAsMaster()  {}
+func (l *fakeListener) OnStartAsSlave()   {}
+func (l *fakeListener) OnSwitchToMaster() {}
+func (l *fakeListener) OnSwitchToSlave()  { l.switchedToSlave = true }
+func (l *fakeListener) OnUnhealthy()      {}
+func (l *fakeListener) OnRecovered()      {}
+
+func TestResignGivesUpMasterAndNotifiesListeners(t *testing.T) {
+	fe := &fakeElection{}
+	listener := &fakeListener{}
+
+	e := &MasterElector{logger: logging.GetLogger(), election: fe, isMaster: true}
+	e.AddEventListener(listener)
+
+	if err := e.Resign(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !fe.resigned {
+		t.Fatalf("expected Resign to be called on the underlying election")
+	}
+	if e.IsMaster() {
+		t.Fatalf("expected IsMaster to be false after Resign")
+	}
+	if !listener.switchedToSlave {
+		t.Fatalf("expected OnSwitchToSlave to be fired after Resign")
+	}
+}
+
+func TestResignPropagatesElectionError(t *testing.T) {
+	fe := &fakeElection{resignErr: errors.New("boom")}
+	e := &MasterElector{logger: logging.GetLogger(), election: fe, isMaster: true}
+
+	if err := e.Resign(context.Background()); err == nil {
+		t.Fatalf("expected the election's Resign error to be propagated")
+	}
+	if !e.IsMaster() {
+		t.Fatalf("expected IsMaster to stay true when Resign fails")
+	}
+}
+
+func TestResignOnUnstartedElectorIsANoOp(t *testing.T) {
+	e := &MasterElector{logger: logging.GetLogger()}
+	if err := e.Resign(context.Background()); err != nil {
+		t.Fatalf("expected no error resigning an elector that was never started, got %s", err)
+	}
+}
+
+// TestStopCampaignWaitsForCampaignGoroutine exercises the session-rebuild
+// teardown path shared by Stop and rebuildSession: it must cancel the
+// context and wait for every goroutine run() started - including the
+// Campaign goroutine - before returning, so that rebuildSession never
+// replaces the session out from under a still-running campaign.
+func TestStopCampaignWaitsForCampaignGoroutine(t *testing.T) {
+	e := &MasterElector{logger: logging.GetLogger()}
+
+	canceled := make(chan struct{})
+	e.cancel = func() { close(canceled) }
+
+	finished := false
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		<-canceled
+		finished = true
+	}()
+
+	e.stopCampaign()
+
+	if !finished {
+		t.Fatalf("expected stopCampaign to wait for the tracked goroutine to finish")
+	}
+}
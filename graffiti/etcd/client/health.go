@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// healthCheckTicker builds the ticker channel driving the watch-loop
+// health detector. It is a package-level hook, in the spirit of
+// PD's failpoints, so that tests can force fast ticks instead of waiting
+// on DetectHealthyInterval in real time.
+var healthCheckTicker = func(interval time.Duration) <-chan time.Time {
+	return time.NewTicker(interval).C
+}
+
+// registerElector makes the elector a target of the health notifications
+// (OnUnhealthy/OnRecovered) fired by this client's watch loop, and lets the
+// health loop rebuild the elector's session when the connection has been
+// silently wedged.
+//
+// The electors list is guarded by its own mutex, separate from healthMu.
+// registerElector is called from MasterElector.Start(), which is itself
+// invoked by rebuildSession() from the watch-loop goroutine; probe()
+// releases healthMu, and takes a snapshot of the electors, before calling
+// rebuildSession(), so neither lock is held when registerElector runs.
+func (client *Client) registerElector(e *MasterElector) {
+	client.electorsMu.Lock()
+	defer client.electorsMu.Unlock()
+	for _, existing := range client.electors {
+		if existing == e {
+			return
+		}
+	}
+	client.electors = append(client.electors, e)
+}
+
+// snapshotElectors returns a copy of the registered electors, safe to
+// range over without holding electorsMu.
+func (client *Client) snapshotElectors() []*MasterElector {
+	client.electorsMu.Lock()
+	defer client.electorsMu.Unlock()
+	return append([]*MasterElector(nil), client.electors...)
+}
+
+// startHealthDetector starts, in background, the goroutine that probes the
+// etcd cluster on DetectHealthyInterval and declares the client unhealthy
+// once WatchLoopUnhealthyTimeout has elapsed without a successful probe.
+func (client *Client) startHealthDetector() {
+	go client.watchLoop()
+}
+
+func (client *Client) stopHealthDetector() {
+	select {
+	case <-client.stopHealth:
+		// already closed
+	default:
+		close(client.stopHealth)
+	}
+}
+
+func (client *Client) watchLoop() {
+	ticks := healthCheckTicker(client.detectHealthyInterval)
+
+	for {
+		select {
+		case <-client.stopHealth:
+			return
+		case <-ticks:
+			client.probe()
+		}
+	}
+}
+
+// probe issues a lightweight Get against the cluster and updates
+// lastHealthyTime on success. When no successful probe has occurred within
+// watchLoopUnhealthyTimeout, the client is marked unhealthy, its elections'
+// sessions are torn down and rebuilt, and registered listeners are
+// notified through OnUnhealthy/OnRecovered.
+func (client *Client) probe() {
+	ctx, cancel := context.WithTimeout(context.Background(), client.detectHealthyInterval)
+	defer cancel()
+
+	_, err := client.KV.Get(ctx, "/")
+
+	client.healthMu.Lock()
+	becameRecovered := false
+	becameUnhealthy := false
+
+	if err == nil {
+		client.lastHealthyTime = time.Now()
+		if client.unhealthy {
+			client.unhealthy = false
+			becameRecovered = true
+		}
+	} else if !client.unhealthy && time.Since(client.lastHealthyTime) > client.watchLoopUnhealthyTimeout {
+		client.unhealthy = true
+		client.logger.Errorf("Etcd watch loop unhealthy: no successful request in %s: %s", client.watchLoopUnhealthyTimeout, err)
+		becameUnhealthy = true
+	}
+	client.healthMu.Unlock()
+
+	// notify and rebuild outside of healthMu: MasterElector.rebuildSession
+	// calls back into MasterElector.Start(), which registers the elector
+	// again through registerElector - that must not contend with a lock
+	// still held by this goroutine.
+	if becameUnhealthy {
+		for _, e := range client.snapshotElectors() {
+			e.rebuildSession()
+			e.notifyUnhealthy()
+		}
+	} else if becameRecovered {
+		for _, e := range client.snapshotElectors() {
+			e.notifyRecovered()
+		}
+	}
+}
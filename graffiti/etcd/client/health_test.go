@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/skydive-project/skydive/graffiti/logging"
+)
+
+// fakeKV is a clientv3.KV whose Get is scriptable and counted; the other
+// methods are never exercised by the health detector and just satisfy the
+// interface.
+type fakeKV struct {
+	mu       sync.Mutex
+	getErr   error
+	getCalls int32
+}
+
+func (k *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	atomic.AddInt32(&k.getCalls, 1)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.getErr != nil {
+		return nil, k.getErr
+	}
+	return &clientv3.GetResponse{}, nil
+}
+
+func (k *fakeKV) setErr(err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.getErr = err
+}
+
+func (k *fakeKV) calls() int32 { return atomic.LoadInt32(&k.getCalls) }
+
+func (k *fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return &clientv3.PutResponse{}, nil
+}
+
+func (k *fakeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	return &clientv3.DeleteResponse{}, nil
+}
+
+func (k *fakeKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return &clientv3.CompactResponse{}, nil
+}
+
+func (k *fakeKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	return clientv3.OpResponse{}, nil
+}
+
+func (k *fakeKV) Txn(ctx context.Context) clientv3.Txn {
+	panic("not implemented by fakeKV")
+}
+
+func newTestClient(kv *fakeKV) *Client {
+	return &Client{
+		KV:                        kv,
+		logger:                    logging.GetLogger(),
+		detectHealthyInterval:     time.Millisecond,
+		watchLoopUnhealthyTimeout: 10 * time.Millisecond,
+		lastHealthyTime:           time.Now(),
+		stopHealth:                make(chan struct{}),
+	}
+}
+
+func TestProbeMarksUnhealthyThenRecovered(t *testing.T) {
+	kv := &fakeKV{getErr: context.DeadlineExceeded}
+	c := newTestClient(kv)
+	c.lastHealthyTime = time.Now().Add(-time.Hour)
+
+	c.probe()
+	if !c.unhealthy {
+		t.Fatalf("expected probe to mark the client unhealthy once past watchLoopUnhealthyTimeout")
+	}
+
+	kv.setErr(nil)
+	c.probe()
+	if c.unhealthy {
+		t.Fatalf("expected probe to clear unhealthy once a Get succeeds again")
+	}
+}
+
+// TestWatchLoopUsesHealthCheckTickerHook exercises the healthCheckTicker
+// hook: watchLoop must drive its probes off whatever channel the hook
+// returns, so tests can force ticks instead of waiting on
+// DetectHealthyInterval in real time.
+func TestWatchLoopUsesHealthCheckTickerHook(t *testing.T) {
+	ticks := make(chan time.Time, 1)
+	original := healthCheckTicker
+	healthCheckTicker = func(time.Duration) <-chan time.Time { return ticks }
+	defer func() { healthCheckTicker = original }()
+
+	kv := &fakeKV{}
+	c := newTestClient(kv)
+
+	go c.watchLoop()
+	defer close(c.stopHealth)
+
+	ticks <- time.Now()
+
+	deadline := time.Now().Add(time.Second)
+	for kv.calls() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if kv.calls() == 0 {
+		t.Fatalf("expected watchLoop to probe through the injected healthCheckTicker channel")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package forwarder
+
+import (
+	"sync"
+
+	"github.com/skydive-project/skydive/graffiti/messages"
+)
+
+// eventBuffer is a bounded ring buffer of graph event messages. It is used
+// by the Forwarder to hold on to events produced while it has no master to
+// forward them to, instead of dropping them. Once it is full, the oldest
+// event is evicted to make room for the newest one.
+type eventBuffer struct {
+	mu       sync.Mutex
+	events   []*messages.StructMessage
+	capacity int
+	start    int
+	size     int
+	dropped  int
+}
+
+// newEventBuffer creates a ring buffer able to hold up to capacity events.
+func newEventBuffer(capacity int) *eventBuffer {
+	return &eventBuffer{
+		events:   make([]*messages.StructMessage, capacity),
+		capacity: capacity,
+	}
+}
+
+// push appends a message to the buffer, evicting the oldest one if the
+// buffer is already full.
+func (b *eventBuffer) push(msg *messages.StructMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := (b.start + b.size) % b.capacity
+	if b.size == b.capacity {
+		b.start = (b.start + 1) % b.capacity
+		b.dropped++
+	} else {
+		b.size++
+	}
+	b.events[idx] = msg
+}
+
+// flush returns the buffered messages, in FIFO order, along with the
+// number of events that were dropped because the buffer was full, and
+// empties the buffer.
+func (b *eventBuffer) flush() ([]*messages.StructMessage, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msgs := make([]*messages.StructMessage, b.size)
+	for i := 0; i < b.size; i++ {
+		msgs[i] = b.events[(b.start+i)%b.capacity]
+	}
+	dropped := b.dropped
+
+	b.start, b.size, b.dropped = 0, 0, 0
+	b.events = make([]*messages.StructMessage, b.capacity)
+
+	return msgs, dropped
+}
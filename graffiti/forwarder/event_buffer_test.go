@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/skydive-project/skydive/graffiti/messages"
+)
+
+func msgWithKind(kind messages.MessageType) *messages.StructMessage {
+	return messages.NewStructMessage(kind, nil)
+}
+
+func TestEventBufferFlushReturnsInFIFOOrder(t *testing.T) {
+	b := newEventBuffer(3)
+	b.push(msgWithKind("one"))
+	b.push(msgWithKind("two"))
+	b.push(msgWithKind("three"))
+
+	msgs, dropped := b.flush()
+	if dropped != 0 {
+		t.Fatalf("expected no drops, got %d", dropped)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(msgs))
+	}
+	for i, want := range []messages.MessageType{"one", "two", "three"} {
+		if msgs[i].Kind != want {
+			t.Errorf("message %d: got kind %s, want %s", i, msgs[i].Kind, want)
+		}
+	}
+}
+
+func TestEventBufferEvictsOldestOnWraparound(t *testing.T) {
+	b := newEventBuffer(2)
+	b.push(msgWithKind("one"))
+	b.push(msgWithKind("two"))
+	b.push(msgWithKind("three"))
+
+	msgs, dropped := b.flush()
+	if dropped != 1 {
+		t.Fatalf("expected 1 drop, got %d", dropped)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Kind != "two" || msgs[1].Kind != "three" {
+		t.Fatalf("expected [two three], got [%s %s]", msgs[0].Kind, msgs[1].Kind)
+	}
+}
+
+func TestEventBufferFlushEmptiesAndResetsDropCount(t *testing.T) {
+	b := newEventBuffer(1)
+	b.push(msgWithKind("one"))
+	b.push(msgWithKind("two"))
+
+	if _, dropped := b.flush(); dropped != 1 {
+		t.Fatalf("expected 1 drop on first flush, got %d", dropped)
+	}
+
+	msgs, dropped := b.flush()
+	if len(msgs) != 0 || dropped != 0 {
+		t.Fatalf("expected an empty buffer after flush, got %d messages and %d drops", len(msgs), dropped)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package forwarder
+
+import (
+	"sync/atomic"
+
+	"github.com/skydive-project/skydive/graffiti/messages"
+	ws "github.com/skydive-project/skydive/graffiti/websocket"
+)
+
+// Mode selects how a Forwarder distributes graph events.
+type Mode int
+
+const (
+	// ModeSingleMaster forwards events to the single elected master only,
+	// and does a (partial or full) re-sync on every master switch. This
+	// is the default, and the historical behavior of the Forwarder.
+	ModeSingleMaster Mode = iota
+	// ModeFanOut keeps the election semantics for control messages, but
+	// mirrors every graph event to all healthy speakers of the pool, so
+	// that standbys have a warm graph by the time they are elected.
+	ModeFanOut
+)
+
+// DefaultMaxLagMessages is the default backpressure threshold of the
+// fan-out set: it is both the capacity of each speaker's send queue and the
+// number of messages a speaker may have rejected, because its queue was
+// full, since its last delivered message before it is dropped from the
+// fan-out set.
+const DefaultMaxLagMessages = 1000
+
+// Option configures optional behavior of a Forwarder created with
+// NewForwarder.
+type Option func(*Forwarder)
+
+// WithMode sets the forwarding mode. Defaults to ModeSingleMaster.
+func WithMode(mode Mode) Option {
+	return func(t *Forwarder) {
+		t.mode = mode
+	}
+}
+
+// WithMaxLagMessages overrides DefaultMaxLagMessages, the backpressure
+// threshold used in ModeFanOut.
+func WithMaxLagMessages(n int) Option {
+	return func(t *Forwarder) {
+		t.maxLagMessages = n
+	}
+}
+
+// fanOutPeer drives the message queue of a single mirrored speaker. A
+// dedicated goroutine drains the queue so that a slow speaker never blocks
+// the primary forwarding path.
+type fanOutPeer struct {
+	id      string
+	speaker ws.Speaker
+	queue   chan *messages.StructMessage
+	quit    chan struct{}
+	lag     int32
+}
+
+func newFanOutPeer(id string, speaker ws.Speaker, capacity int) *fanOutPeer {
+	p := &fanOutPeer{
+		id:      id,
+		speaker: speaker,
+		queue:   make(chan *messages.StructMessage, capacity),
+		quit:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *fanOutPeer) run() {
+	for {
+		select {
+		case <-p.quit:
+			return
+		case msg := <-p.queue:
+			p.speaker.SendMessage(msg)
+			atomic.StoreInt32(&p.lag, 0)
+		}
+	}
+}
+
+// enqueue returns false, and counts one unit of lag, if the peer's queue is
+// full.
+func (p *fanOutPeer) enqueue(msg *messages.StructMessage) bool {
+	select {
+	case p.queue <- msg:
+		return true
+	default:
+		atomic.AddInt32(&p.lag, 1)
+		return false
+	}
+}
+
+func (p *fanOutPeer) stop() {
+	close(p.quit)
+}
+
+// maxLag returns the configured MaxLagMessages, falling back to
+// DefaultMaxLagMessages when unset.
+func (t *Forwarder) maxLag() int {
+	if t.maxLagMessages <= 0 {
+		return DefaultMaxLagMessages
+	}
+	return t.maxLagMessages
+}
+
+// addFanOutPeer sends the new speaker a full graph snapshot, so it has a
+// warm graph to build on, then registers it as a fan-out mirror target. It
+// is called by the websocket layer when a speaker joins the pool while the
+// Forwarder is running in ModeFanOut.
+//
+// The snapshot send and the fan-out registration both happen while holding
+// graph.RLock(): any graph mutation needs the graph's write Lock(), so
+// holding the read lock across both steps guarantees no event can slip
+// through the gap between "speaker got the snapshot" and "speaker is now
+// in the live mirror set" - closing it would leave that event in neither.
+func (t *Forwarder) addFanOutPeer(c ws.Speaker) {
+	id := masterIdentity(c)
+
+	t.graph.RLock()
+	defer t.graph.RUnlock()
+
+	msg := &messages.SyncMsg{Elements: t.graph.Elements()}
+	c.SendMessage(messages.NewStructMessage(messages.SyncMsgType, msg))
+
+	t.fanOutMu.Lock()
+	defer t.fanOutMu.Unlock()
+
+	if t.fanOut == nil {
+		t.fanOut = make(map[string]*fanOutPeer)
+	}
+	if old, ok := t.fanOut[id]; ok {
+		t.logger.Warningf("Speaker %s reconnected to the fan-out mirror set, replacing stale entry", id)
+		old.stop()
+	}
+	t.fanOut[id] = newFanOutPeer(id, c, t.maxLag())
+}
+
+// removeFanOutPeer drops a speaker from the fan-out set, whether because
+// it disconnected or because it fell too far behind.
+func (t *Forwarder) removeFanOutPeer(id string) {
+	t.fanOutMu.Lock()
+	peer, ok := t.fanOut[id]
+	if ok {
+		delete(t.fanOut, id)
+	}
+	t.fanOutMu.Unlock()
+
+	if ok {
+		peer.stop()
+	}
+}
+
+// fanOutSend tags the message with the current master epoch and mirrors
+// it to every healthy speaker in the fan-out set. A message that finds a
+// speaker's queue full is not delivered to that speaker; a speaker that has
+// rejected more than MaxLagMessages messages since its last delivery is
+// considered degraded and dropped from the set rather than stalling the
+// primary forwarding path.
+func (t *Forwarder) fanOutSend(msg *messages.StructMessage) {
+	msg.Epoch = atomic.LoadUint64(&t.epoch)
+
+	t.fanOutMu.Lock()
+	peers := make([]*fanOutPeer, 0, len(t.fanOut))
+	for _, p := range t.fanOut {
+		peers = append(peers, p)
+	}
+	t.fanOutMu.Unlock()
+
+	for _, p := range peers {
+		if p.enqueue(msg) {
+			continue
+		}
+		if int(atomic.LoadInt32(&p.lag)) > t.maxLag() {
+			t.logger.Warningf("Speaker %s fell behind by more than %d messages, dropping it from the fan-out mirror set (degraded mirror)", p.id, t.maxLag())
+			t.removeFanOutPeer(p.id)
+		}
+	}
+}
+
+// onNewFanOutMaster bumps the epoch and sends a short EpochSyncMsg catch-up
+// handshake to the newly elected master instead of a full or partial
+// re-sync: since the master was already mirrored every event, it only
+// needs to know the current epoch to start accepting live updates again.
+func (t *Forwarder) onNewFanOutMaster(c ws.Speaker) {
+	epoch := atomic.AddUint64(&t.epoch, 1)
+	t.logger.Infof("Fan-out catch-up handshake with new master, epoch %d", epoch)
+
+	msg := &messages.EpochSyncMsg{Epoch: epoch}
+	t.masterElection.SendMessageToMaster(messages.NewStructMessage(messages.EpochSyncMsgType, msg))
+}
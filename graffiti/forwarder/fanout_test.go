@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package forwarder
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/skydive-project/skydive/graffiti/logging"
+	"github.com/skydive-project/skydive/graffiti/messages"
+)
+
+// TestFanOutPeerEnqueueDropsWhenQueueFull exercises enqueue directly,
+// without the draining goroutine newFanOutPeer would normally start, so the
+// queue-full path is deterministic instead of racing a consumer.
+func TestFanOutPeerEnqueueDropsWhenQueueFull(t *testing.T) {
+	p := &fanOutPeer{
+		id:    "peer",
+		queue: make(chan *messages.StructMessage, 2),
+	}
+	msg := messages.NewStructMessage(messages.NodeAddedMsgType, nil)
+
+	if !p.enqueue(msg) || !p.enqueue(msg) {
+		t.Fatalf("expected the first two enqueues to fit in the queue")
+	}
+	if p.enqueue(msg) {
+		t.Fatalf("expected enqueue to fail once the queue is full")
+	}
+	if lag := atomic.LoadInt32(&p.lag); lag != 1 {
+		t.Fatalf("expected lag to be 1 after a single dropped message, got %d", lag)
+	}
+}
+
+// TestFanOutSendDropsPeerPastMaxLag exercises the backpressure-eviction path
+// of fanOutSend: a peer whose queue stays full across more than maxLag
+// sends is dropped from the fan-out set, rather than stalling every other
+// peer.
+func TestFanOutSendDropsPeerPastMaxLag(t *testing.T) {
+	// an unbuffered, undrained queue: every enqueue fails, incrementing lag.
+	peer := &fanOutPeer{id: "peer", queue: make(chan *messages.StructMessage), quit: make(chan struct{})}
+
+	tr := &Forwarder{
+		logger:         logging.GetLogger(),
+		mode:           ModeFanOut,
+		maxLagMessages: 1,
+		fanOut:         map[string]*fanOutPeer{"peer": peer},
+	}
+
+	msg := messages.NewStructMessage(messages.NodeAddedMsgType, nil)
+
+	tr.fanOutSend(msg)
+	if _, ok := tr.fanOut["peer"]; !ok {
+		t.Fatalf("expected peer to still be present after a single lagging send")
+	}
+
+	tr.fanOutSend(msg)
+	if _, ok := tr.fanOut["peer"]; ok {
+		t.Fatalf("expected peer to be dropped once its lag exceeded maxLagMessages")
+	}
+}
@@ -18,13 +18,31 @@
 package forwarder
 
 import (
-    "os"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/skydive-project/skydive/graffiti/graph"
 	"github.com/skydive-project/skydive/graffiti/logging"
 	"github.com/skydive-project/skydive/graffiti/messages"
 	ws "github.com/skydive-project/skydive/graffiti/websocket"
 )
 
+const (
+	// DefaultMaxFailoverDuration is the maximum amount of time the
+	// Forwarder waits, after losing its master, for a new one to be
+	// elected before it gives up and exits.
+	DefaultMaxFailoverDuration = 30 * time.Second
+
+	// defaultEventBufferSize is the number of graph events kept in the
+	// in-memory ring buffer while the Forwarder has no master.
+	defaultEventBufferSize = 5000
+
+	reElectionBaseBackoff = 100 * time.Millisecond
+	reElectionMaxBackoff  = 5 * time.Second
+)
+
 // Forwarder forwards the topology to only one master server.
 // When switching from one analyzer to another one the agent does a full
 // re-sync since some messages could have been lost.
@@ -32,16 +50,269 @@ type Forwarder struct {
 	masterElection *ws.MasterElection
 	graph          *graph.Graph
 	logger         logging.Logger
+
+	// MaxFailoverDuration bounds how long the Forwarder tolerates being
+	// without a master before exiting. It defaults to
+	// DefaultMaxFailoverDuration.
+	MaxFailoverDuration time.Duration
+
+	mu             sync.Mutex
+	failoverTarget string
+	buffering      bool
+	buffer         *eventBuffer
+
+	// lastAck tracks, per master identity, the highest Revision that
+	// master has acknowledged, so that a reconnection can ship only what
+	// changed since then instead of the whole graph.
+	lastAck map[string]int64
+	// tombstones holds the IDs of elements whose deletion the Forwarder
+	// observed since the last acknowledged re-sync, for inclusion in the
+	// next partial re-sync.
+	tombstones []graph.Identifier
+	// syncing is true between sending a (partial or full) sync message
+	// and receiving its ack; events produced in that window are folded
+	// into pendingOps rather than sent directly, since the master isn't
+	// ready yet to receive live events.
+	syncing    bool
+	pendingOps *eventBuffer
+
+	// mode selects between ModeSingleMaster (default) and ModeFanOut.
+	mode           Mode
+	pool           ws.StructSpeakerPool
+	maxLagMessages int
+	epoch          uint64
+
+	fanOutMu sync.Mutex
+	fanOut   map[string]*fanOutPeer
+}
+
+// masterIdentity returns a stable identifier for a master Speaker, used as
+// the key under which the last acknowledged Revision is kept.
+func masterIdentity(c ws.Speaker) string {
+	addr, port := c.GetAddrPort()
+	return fmt.Sprintf("%s:%d", addr, port)
 }
 
-func (t *Forwarder) triggerResync() {
-	t.logger.Infof("Start a re-sync")
+// triggerResync ships the graph to the given master. When a Revision was
+// already acknowledged by that same master identity, only the elements
+// changed since then plus the pending tombstones are sent as a
+// messages.PartialSyncMsg; otherwise (new master, or unknown watermark
+// reported back) the full graph is sent as a messages.SyncMsg.
+func (t *Forwarder) triggerResync(c ws.Speaker) {
+	id := masterIdentity(c)
+
+	t.mu.Lock()
+	lastAck, known := t.lastAck[id]
+	t.syncing = true
+	if t.pendingOps == nil {
+		t.pendingOps = newEventBuffer(defaultEventBufferSize)
+	}
+	t.mu.Unlock()
+
+	if known {
+		t.logger.Infof("Start a partial re-sync from revision %d", lastAck)
+
+		t.mu.Lock()
+		tombstones := append([]graph.Identifier(nil), t.tombstones...)
+		t.mu.Unlock()
+
+		msg := &messages.PartialSyncMsg{
+			Elements:   t.graph.ElementsSince(lastAck),
+			Tombstones: tombstones,
+		}
+		c.SendMessage(messages.NewStructMessage(messages.PartialSyncMsgType, msg))
+		return
+	}
+
+	t.logger.Infof("Start a full re-sync")
 
 	// re-add all the nodes and edges
 	msg := &messages.SyncMsg{
 		Elements: t.graph.Elements(),
 	}
-	t.masterElection.SendMessageToMaster(messages.NewStructMessage(messages.SyncMsgType, msg))
+	c.SendMessage(messages.NewStructMessage(messages.SyncMsgType, msg))
+}
+
+// OnSyncAck is called by the websocket layer when the master replies to a
+// (partial or full) re-sync with a messages.SyncAckMsg. A negative
+// HighWatermark means the master couldn't use the
+// partial sync (new analyzer, compacted state, schema change) and a full
+// resync is triggered as fallback.
+func (t *Forwarder) OnSyncAck(c ws.Speaker, ack *messages.SyncAckMsg) {
+	id := masterIdentity(c)
+
+	if ack.HighWatermark < 0 {
+		t.logger.Warningf("Master %s reported an unknown watermark, falling back to a full re-sync", id)
+		t.mu.Lock()
+		delete(t.lastAck, id)
+		t.mu.Unlock()
+		t.graph.RLock()
+		t.triggerResync(c)
+		t.graph.RUnlock()
+		return
+	}
+
+	t.mu.Lock()
+	if t.lastAck == nil {
+		t.lastAck = make(map[string]int64)
+	}
+	t.lastAck[id] = ack.HighWatermark
+	// the master has the up to date set of tombstones, drop them now
+	t.tombstones = nil
+	t.syncing = false
+	pending := t.pendingOps
+	t.pendingOps = nil
+	t.mu.Unlock()
+
+	// synced can now listen the graph
+	t.graph.AddEventListener(t)
+
+	if pending != nil {
+		msgs, dropped := pending.flush()
+		if dropped > 0 {
+			t.logger.Warningf("Dropped %d graph events produced during partial re-sync", dropped)
+		}
+		for _, msg := range msgs {
+			t.masterElection.SendMessageToMaster(msg)
+		}
+	}
+
+	t.replayBuffered()
+}
+
+// setFailoverTarget records the successor a draining master advertised
+// through a LeadershipTransferMsg so that a future master loss can be
+// resolved by connecting directly to it instead of waiting for a fresh
+// election to complete.
+func (t *Forwarder) setFailoverTarget(targetID string) {
+	t.mu.Lock()
+	t.failoverTarget = targetID
+	t.mu.Unlock()
+}
+
+// OnLeadershipTransfer is called when the current master announces, ahead
+// of disappearing, the peer that agents should migrate to. It is invoked
+// by the websocket layer upon receiving a messages.LeadershipTransferMsg.
+func (t *Forwarder) OnLeadershipTransfer(targetID string) {
+	t.logger.Infof("Master announced leadership transfer to %s", targetID)
+	t.setFailoverTarget(targetID)
+}
+
+// startBuffering switches the Forwarder into buffering mode: graph events
+// produced while there is no master are appended to a bounded ring buffer
+// instead of being dropped on the floor.
+func (t *Forwarder) startBuffering() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buffering {
+		return
+	}
+	t.buffering = true
+	if t.buffer == nil {
+		t.buffer = newEventBuffer(defaultEventBufferSize)
+	}
+}
+
+// replayBuffered flushes the buffered graph events to the new master, in
+// the order they were recorded, once the resync snapshot has been
+// acknowledged.
+func (t *Forwarder) replayBuffered() {
+	t.mu.Lock()
+	t.buffering = false
+	buf := t.buffer
+	t.buffer = nil
+	t.mu.Unlock()
+
+	if buf == nil {
+		return
+	}
+
+	msgs, dropped := buf.flush()
+	if dropped > 0 {
+		t.logger.Warningf("Dropped %d graph events while buffering during failover", dropped)
+	}
+	for _, msg := range msgs {
+		t.masterElection.SendMessageToMaster(msg)
+	}
+}
+
+// sendOrBuffer forwards the message to the master, or stores it in the
+// ring buffer when the Forwarder currently has no master to talk to, or
+// folds it into pendingOps when a (partial or full) re-sync is still
+// awaiting its ack.
+func (t *Forwarder) sendOrBuffer(msg *messages.StructMessage) {
+	if t.mode == ModeFanOut {
+		t.fanOutSend(msg)
+		return
+	}
+
+	t.mu.Lock()
+	buffering := t.buffering
+	buf := t.buffer
+	syncing := t.syncing
+	pending := t.pendingOps
+	t.mu.Unlock()
+
+	if buffering && buf != nil {
+		buf.push(msg)
+		return
+	}
+
+	if syncing && pending != nil {
+		pending.push(msg)
+		return
+	}
+
+	t.masterElection.SendMessageToMaster(msg)
+}
+
+// failoverDuration returns the configured MaxFailoverDuration, falling
+// back to DefaultMaxFailoverDuration when unset.
+func (t *Forwarder) failoverDuration() time.Duration {
+	if t.MaxFailoverDuration <= 0 {
+		return DefaultMaxFailoverDuration
+	}
+	return t.MaxFailoverDuration
+}
+
+// handleFailover runs after the master is lost. It first tries the
+// designated transfer target, if any was announced, then falls back to
+// waiting for a fresh election with exponential backoff. If no master
+// shows up within MaxFailoverDuration, the process exits so that it can be
+// restarted in a clean state.
+func (t *Forwarder) handleFailover() {
+	deadline := time.Now().Add(t.failoverDuration())
+
+	t.mu.Lock()
+	target := t.failoverTarget
+	t.mu.Unlock()
+
+	if target != "" {
+		t.logger.Infof("Trying failover target %s first", target)
+		if t.masterElection.ConnectTo(target) {
+			return
+		}
+		t.logger.Warningf("Failed to connect to failover target %s, falling back to re-election", target)
+	}
+
+	backoff := reElectionBaseBackoff
+	for time.Now().Before(deadline) {
+		if t.masterElection.GetMaster() != nil {
+			return
+		}
+		time.Sleep(backoff)
+		if backoff < reElectionMaxBackoff {
+			backoff *= 2
+			if backoff > reElectionMaxBackoff {
+				backoff = reElectionMaxBackoff
+			}
+		}
+	}
+
+	if t.masterElection.GetMaster() == nil {
+		t.logger.Errorf("No master elected after %s, exiting", t.failoverDuration())
+		os.Exit(1)
+	}
 }
 
 // OnNewMaster is called by the master election mechanism when a new master is elected. In
@@ -50,28 +321,60 @@ func (t *Forwarder) OnNewMaster(c ws.Speaker) {
 	if c == nil {
 		t.logger.Warning("Lost connection to master")
 
-		// do not forward message before re-sync
-		t.graph.RemoveEventListener(t)
+		if t.mode == ModeFanOut {
+			// the rest of the fan-out set keeps mirroring live events
+			// regardless of the control master; only the re-election
+			// itself needs to happen
+			go t.handleFailover()
+			return
+		}
 
-		os.Exit(1)
+		// keep the graph event listener registered so OnNode*/OnEdge*
+		// keep firing and sendOrBuffer keeps seeing them; startBuffering
+		// is what makes sendOrBuffer hold on to them instead of trying
+		// to forward them to the master that was just lost
+		t.startBuffering()
+
+		go t.handleFailover()
 	} else {
 		addr, port := c.GetAddrPort()
 		t.logger.Infof("Using %s:%d as master of topology forwarder", addr, port)
 
+		if t.mode == ModeFanOut {
+			t.onNewFanOutMaster(c)
+			t.graph.AddEventListener(t)
+			return
+		}
+
 		t.graph.RLock()
+		t.triggerResync(c)
+		t.graph.RUnlock()
 
-		t.triggerResync()
+		// t.graph's event listener is re-added, and buffered events
+		// replayed, once the master acknowledges the sync in OnSyncAck
+	}
+}
 
-		// synced can now listen the graph
-		t.graph.AddEventListener(t)
+// OnConnected is called by the StructSpeakerPool when a new speaker joins.
+// In ModeFanOut, the speaker is added to the mirror set so it starts
+// receiving every graph event right away.
+func (t *Forwarder) OnConnected(c ws.Speaker) {
+	if t.mode == ModeFanOut {
+		t.addFanOutPeer(c)
+	}
+}
 
-		t.graph.RUnlock()
+// OnDisconnected is called by the StructSpeakerPool when a speaker leaves.
+// In ModeFanOut, it is removed from the mirror set.
+func (t *Forwarder) OnDisconnected(c ws.Speaker) {
+	if t.mode == ModeFanOut {
+		t.removeFanOutPeer(masterIdentity(c))
 	}
 }
 
 // OnNodeUpdated graph node updated event. Implements the EventListener interface.
 func (t *Forwarder) OnNodeUpdated(n *graph.Node, ops []graph.PartiallyUpdatedOp) {
-	t.masterElection.SendMessageToMaster(
+	t.sendOrBuffer(
 		messages.NewStructMessage(
 			messages.NodePartiallyUpdatedMsgType,
 			messages.PartiallyUpdatedMsg{
@@ -86,21 +389,18 @@ func (t *Forwarder) OnNodeUpdated(n *graph.Node, ops []graph.PartiallyUpdatedOp)
 
 // OnNodeAdded graph node added event. Implements the EventListener interface.
 func (t *Forwarder) OnNodeAdded(n *graph.Node) {
-	t.masterElection.SendMessageToMaster(
-		messages.NewStructMessage(messages.NodeAddedMsgType, n),
-	)
+	t.sendOrBuffer(messages.NewStructMessage(messages.NodeAddedMsgType, n))
 }
 
 // OnNodeDeleted graph node deleted event. Implements the EventListener interface.
 func (t *Forwarder) OnNodeDeleted(n *graph.Node) {
-	t.masterElection.SendMessageToMaster(
-		messages.NewStructMessage(messages.NodeDeletedMsgType, n),
-	)
+	t.addTombstone(n.ID)
+	t.sendOrBuffer(messages.NewStructMessage(messages.NodeDeletedMsgType, n))
 }
 
 // OnEdgeUpdated graph edge updated event. Implements the EventListener interface.
 func (t *Forwarder) OnEdgeUpdated(e *graph.Edge, ops []graph.PartiallyUpdatedOp) {
-	t.masterElection.SendMessageToMaster(
+	t.sendOrBuffer(
 		messages.NewStructMessage(
 			messages.EdgePartiallyUpdatedMsgType,
 			messages.PartiallyUpdatedMsg{
@@ -115,16 +415,23 @@ func (t *Forwarder) OnEdgeUpdated(e *graph.Edge, ops []graph.PartiallyUpdatedOp)
 
 // OnEdgeAdded graph edge added event. Implements the EventListener interface.
 func (t *Forwarder) OnEdgeAdded(e *graph.Edge) {
-	t.masterElection.SendMessageToMaster(
-		messages.NewStructMessage(messages.EdgeAddedMsgType, e),
-	)
+	t.sendOrBuffer(messages.NewStructMessage(messages.EdgeAddedMsgType, e))
 }
 
 // OnEdgeDeleted graph edge deleted event. Implements the EventListener interface.
 func (t *Forwarder) OnEdgeDeleted(e *graph.Edge) {
-	t.masterElection.SendMessageToMaster(
-		messages.NewStructMessage(messages.EdgeDeletedMsgType, e),
-	)
+	t.addTombstone(e.ID)
+	t.sendOrBuffer(messages.NewStructMessage(messages.EdgeDeletedMsgType, e))
+}
+
+// addTombstone records that the given element was deleted, so it can be
+// included in the next partial re-sync. It is only reached through the
+// graph event listener, so deletions made while the Forwarder has no
+// event listener registered on the graph are not recorded.
+func (t *Forwarder) addTombstone(id graph.Identifier) {
+	t.mu.Lock()
+	t.tombstones = append(t.tombstones, id)
+	t.mu.Unlock()
 }
 
 // GetMaster returns the current analyzer the agent is sending its events to
@@ -133,8 +440,10 @@ func (t *Forwarder) GetMaster() ws.Speaker {
 }
 
 // NewForwarder returns a new Graph forwarder which forwards event of the given graph
-// to the given WebSocket JSON speakers.
-func NewForwarder(g *graph.Graph, pool ws.StructSpeakerPool, logger logging.Logger) *Forwarder {
+// to the given WebSocket JSON speakers. By default it runs in
+// ModeSingleMaster; pass WithMode(ModeFanOut) to mirror events to every
+// healthy speaker instead.
+func NewForwarder(g *graph.Graph, pool ws.StructSpeakerPool, logger logging.Logger, opts ...Option) *Forwarder {
 	if logger == nil {
 		logger = logging.GetLogger()
 	}
@@ -142,12 +451,21 @@ func NewForwarder(g *graph.Graph, pool ws.StructSpeakerPool, logger logging.Logg
 	masterElection := ws.NewMasterElection(pool)
 
 	t := &Forwarder{
-		masterElection: masterElection,
-		graph:          g,
-		logger:         logger,
+		masterElection:      masterElection,
+		graph:               g,
+		logger:              logger,
+		MaxFailoverDuration: DefaultMaxFailoverDuration,
+		pool:                pool,
+	}
+
+	for _, opt := range opts {
+		opt(t)
 	}
 
 	masterElection.AddEventHandler(t)
+	if t.mode == ModeFanOut {
+		pool.AddEventHandler(t)
+	}
 
 	return t
 }
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/skydive-project/skydive/graffiti/graph"
+	"github.com/skydive-project/skydive/graffiti/messages"
+	ws "github.com/skydive-project/skydive/graffiti/websocket"
+)
+
+type fakeSpeaker struct {
+	addr string
+	port int
+	sent []*messages.StructMessage
+}
+
+func (s *fakeSpeaker) GetAddrPort() (string, int) { return s.addr, s.port }
+
+func (s *fakeSpeaker) SendMessage(msg *messages.StructMessage) {
+	s.sent = append(s.sent, msg)
+}
+
+func (s *fakeSpeaker) last() *messages.StructMessage {
+	if len(s.sent) == 0 {
+		return nil
+	}
+	return s.sent[len(s.sent)-1]
+}
+
+type fakePool struct {
+	speakers []ws.Speaker
+}
+
+func (p *fakePool) AddEventHandler(handler ws.SpeakerEventHandler)          {}
+func (p *fakePool) AddStructMessageHandler(handler ws.StructMessageHandler) {}
+func (p *fakePool) GetSpeakers() []ws.Speaker                               { return p.speakers }
+func (p *fakePool) GetSpeakerByID(id string) ws.Speaker {
+	for _, s := range p.speakers {
+		if addr, _ := s.GetAddrPort(); addr == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTriggerResyncSendsPartialSyncWithTombstonesWhenWatermarkKnown(t *testing.T) {
+	g := graph.NewGraph()
+	n1 := &graph.Node{ID: "n1"}
+	g.AddNode(n1)
+	watermark := n1.Revision
+
+	n2 := &graph.Node{ID: "n2"}
+	g.AddNode(n2)
+
+	speaker := &fakeSpeaker{addr: "master"}
+	pool := &fakePool{speakers: []ws.Speaker{speaker}}
+	tr := NewForwarder(g, pool, nil)
+
+	id := masterIdentity(speaker)
+	tr.lastAck = map[string]int64{id: watermark}
+	tr.tombstones = []graph.Identifier{"deleted-1"}
+
+	tr.triggerResync(speaker)
+
+	msg := speaker.last()
+	if msg == nil || msg.Kind != messages.PartialSyncMsgType {
+		t.Fatalf("expected a PartialSyncMsg, got %v", msg)
+	}
+
+	partial, ok := msg.Obj.(*messages.PartialSyncMsg)
+	if !ok {
+		t.Fatalf("expected msg.Obj to be a *messages.PartialSyncMsg, got %T", msg.Obj)
+	}
+
+	if len(partial.Tombstones) != 1 || partial.Tombstones[0] != "deleted-1" {
+		t.Fatalf("expected the pending tombstone to be included, got %v", partial.Tombstones)
+	}
+	if len(partial.Elements.Nodes) != 1 || partial.Elements.Nodes[0].ID != "n2" {
+		t.Fatalf("expected only n2 (added after the watermark), got %v", partial.Elements.Nodes)
+	}
+}
+
+func TestTriggerResyncSendsFullSyncWhenWatermarkUnknown(t *testing.T) {
+	g := graph.NewGraph()
+	g.AddNode(&graph.Node{ID: "n1"})
+
+	speaker := &fakeSpeaker{addr: "master"}
+	pool := &fakePool{speakers: []ws.Speaker{speaker}}
+	tr := NewForwarder(g, pool, nil)
+
+	tr.triggerResync(speaker)
+
+	msg := speaker.last()
+	if msg == nil || msg.Kind != messages.SyncMsgType {
+		t.Fatalf("expected a full SyncMsg when no watermark is known, got %v", msg)
+	}
+}
+
+func TestOnSyncAckFallsBackToFullResyncOnNegativeWatermark(t *testing.T) {
+	g := graph.NewGraph()
+	g.AddNode(&graph.Node{ID: "n1"})
+
+	speaker := &fakeSpeaker{addr: "master"}
+	pool := &fakePool{speakers: []ws.Speaker{speaker}}
+	tr := NewForwarder(g, pool, nil)
+
+	id := masterIdentity(speaker)
+	tr.lastAck = map[string]int64{id: 1}
+
+	tr.OnSyncAck(speaker, &messages.SyncAckMsg{HighWatermark: -1})
+
+	if _, known := tr.lastAck[id]; known {
+		t.Fatalf("expected the unknown watermark to clear the recorded one")
+	}
+
+	msg := speaker.last()
+	if msg == nil || msg.Kind != messages.SyncMsgType {
+		t.Fatalf("expected the fallback to trigger a full SyncMsg, got %v", msg)
+	}
+}
+
+func TestOnSyncAckRecordsWatermarkOnSuccess(t *testing.T) {
+	g := graph.NewGraph()
+	speaker := &fakeSpeaker{addr: "master"}
+	pool := &fakePool{speakers: []ws.Speaker{speaker}}
+	tr := NewForwarder(g, pool, nil)
+
+	id := masterIdentity(speaker)
+	tr.OnSyncAck(speaker, &messages.SyncAckMsg{HighWatermark: 42})
+
+	if got := tr.lastAck[id]; got != 42 {
+		t.Fatalf("expected lastAck[%s] to be 42, got %d", id, got)
+	}
+}
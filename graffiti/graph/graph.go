@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package graph holds the in-memory topology graph shared between an agent
+// and the analyzer(s) it forwards its topology to.
+package graph
+
+import (
+	"sync"
+	"time"
+)
+
+// Identifier uniquely identifies a node or an edge in the graph.
+type Identifier string
+
+// PartiallyUpdatedOp describes a single field-level change applied to a
+// node or an edge, as opposed to shipping its whole metadata again.
+type PartiallyUpdatedOp struct {
+	Type  string
+	Key   string
+	Value interface{}
+}
+
+// Node is a vertex of the graph.
+type Node struct {
+	ID        Identifier
+	Revision  int64
+	UpdatedAt time.Time
+	Metadata  map[string]interface{}
+}
+
+// Edge is a link between two nodes of the graph.
+type Edge struct {
+	ID        Identifier
+	Revision  int64
+	UpdatedAt time.Time
+	Parent    Identifier
+	Child     Identifier
+	Metadata  map[string]interface{}
+}
+
+// Elements bundles a set of nodes and edges, as shipped by a full or
+// partial re-sync.
+type Elements struct {
+	Nodes []*Node
+	Edges []*Edge
+}
+
+// EventListener is notified of graph mutations. Forwarder implements this
+// interface to ship every change to the configured master(s).
+type EventListener interface {
+	OnNodeAdded(n *Node)
+	OnNodeUpdated(n *Node, ops []PartiallyUpdatedOp)
+	OnNodeDeleted(n *Node)
+	OnEdgeAdded(e *Edge)
+	OnEdgeUpdated(e *Edge, ops []PartiallyUpdatedOp)
+	OnEdgeDeleted(e *Edge)
+}
+
+// Graph is the in-memory topology graph. Every node and edge carries a
+// Revision, bumped on each add/update/delete, so that consumers can ask
+// for only what changed since a given point instead of the whole graph.
+type Graph struct {
+	sync.RWMutex
+	nodes     map[Identifier]*Node
+	edges     map[Identifier]*Edge
+	seq       int64
+	listeners []EventListener
+}
+
+// NewGraph creates an empty graph.
+func NewGraph() *Graph {
+	return &Graph{
+		nodes: make(map[Identifier]*Node),
+		edges: make(map[Identifier]*Edge),
+	}
+}
+
+// AddEventListener registers a listener for node/edge mutations, unless it
+// is already registered. Callers must not be holding the graph lock.
+func (g *Graph) AddEventListener(l EventListener) {
+	g.Lock()
+	defer g.Unlock()
+	for _, existing := range g.listeners {
+		if existing == l {
+			return
+		}
+	}
+	g.listeners = append(g.listeners, l)
+}
+
+// RemoveEventListener unregisters a previously added listener.
+func (g *Graph) RemoveEventListener(l EventListener) {
+	g.Lock()
+	defer g.Unlock()
+	for i, existing := range g.listeners {
+		if existing == l {
+			g.listeners = append(g.listeners[:i], g.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextRevision must be called with the write lock held.
+func (g *Graph) nextRevision() int64 {
+	g.seq++
+	return g.seq
+}
+
+// AddNode inserts a new node and notifies listeners. Must be called
+// without holding the graph lock.
+func (g *Graph) AddNode(n *Node) {
+	g.Lock()
+	n.Revision = g.nextRevision()
+	n.UpdatedAt = time.Now()
+	g.nodes[n.ID] = n
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnNodeAdded(n)
+	}
+}
+
+// UpdateNode applies partial updates to an existing node and notifies
+// listeners.
+func (g *Graph) UpdateNode(n *Node, ops []PartiallyUpdatedOp) {
+	g.Lock()
+	n.Revision = g.nextRevision()
+	n.UpdatedAt = time.Now()
+	g.nodes[n.ID] = n
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnNodeUpdated(n, ops)
+	}
+}
+
+// DelNode removes a node and notifies listeners.
+func (g *Graph) DelNode(n *Node) {
+	g.Lock()
+	n.Revision = g.nextRevision()
+	delete(g.nodes, n.ID)
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnNodeDeleted(n)
+	}
+}
+
+// AddEdge inserts a new edge and notifies listeners.
+func (g *Graph) AddEdge(e *Edge) {
+	g.Lock()
+	e.Revision = g.nextRevision()
+	e.UpdatedAt = time.Now()
+	g.edges[e.ID] = e
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnEdgeAdded(e)
+	}
+}
+
+// UpdateEdge applies partial updates to an existing edge and notifies
+// listeners.
+func (g *Graph) UpdateEdge(e *Edge, ops []PartiallyUpdatedOp) {
+	g.Lock()
+	e.Revision = g.nextRevision()
+	e.UpdatedAt = time.Now()
+	g.edges[e.ID] = e
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnEdgeUpdated(e, ops)
+	}
+}
+
+// DelEdge removes an edge and notifies listeners.
+func (g *Graph) DelEdge(e *Edge) {
+	g.Lock()
+	e.Revision = g.nextRevision()
+	delete(g.edges, e.ID)
+	listeners := append([]EventListener(nil), g.listeners...)
+	g.Unlock()
+
+	for _, l := range listeners {
+		l.OnEdgeDeleted(e)
+	}
+}
+
+// Elements returns every node and edge currently in the graph. Callers are
+// expected to hold at least a read lock (RLock), the same way the
+// Forwarder does around a full re-sync.
+func (g *Graph) Elements() Elements {
+	elements := Elements{
+		Nodes: make([]*Node, 0, len(g.nodes)),
+		Edges: make([]*Edge, 0, len(g.edges)),
+	}
+	for _, n := range g.nodes {
+		elements.Nodes = append(elements.Nodes, n)
+	}
+	for _, e := range g.edges {
+		elements.Edges = append(elements.Edges, e)
+	}
+	return elements
+}
+
+// ElementsSince returns the nodes and edges whose Revision is strictly
+// greater than the given one, for use in a partial re-sync. Callers are
+// expected to hold at least a read lock (RLock).
+func (g *Graph) ElementsSince(revision int64) Elements {
+	var elements Elements
+	for _, n := range g.nodes {
+		if n.Revision > revision {
+			elements.Nodes = append(elements.Nodes, n)
+		}
+	}
+	for _, e := range g.edges {
+		if e.Revision > revision {
+			elements.Edges = append(elements.Edges, e)
+		}
+	}
+	return elements
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package graph
+
+import "testing"
+
+func idSet(ids ...Identifier) map[Identifier]bool {
+	set := make(map[Identifier]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func nodeIDs(nodes []*Node) map[Identifier]bool {
+	ids := make(map[Identifier]bool, len(nodes))
+	for _, n := range nodes {
+		ids[n.ID] = true
+	}
+	return ids
+}
+
+func edgeIDs(edges []*Edge) map[Identifier]bool {
+	ids := make(map[Identifier]bool, len(edges))
+	for _, e := range edges {
+		ids[e.ID] = true
+	}
+	return ids
+}
+
+func TestElementsSinceFiltersByRevision(t *testing.T) {
+	g := NewGraph()
+
+	n1 := &Node{ID: "n1"}
+	g.AddNode(n1)
+	rev1 := n1.Revision
+
+	n2 := &Node{ID: "n2"}
+	g.AddNode(n2)
+
+	e1 := &Edge{ID: "e1", Parent: "n1", Child: "n2"}
+	g.AddEdge(e1)
+
+	g.UpdateNode(n1, []PartiallyUpdatedOp{{Type: "set", Key: "k", Value: "v"}})
+
+	n3 := &Node{ID: "n3"}
+	g.AddNode(n3)
+	revAfterN3 := n3.Revision
+
+	tests := []struct {
+		name      string
+		since     int64
+		wantNodes map[Identifier]bool
+		wantEdges map[Identifier]bool
+	}{
+		{
+			name:      "since the beginning returns everything",
+			since:     0,
+			wantNodes: idSet("n1", "n2", "n3"),
+			wantEdges: idSet("e1"),
+		},
+		{
+			name:      "since n1's original revision excludes only n1's first add",
+			since:     rev1,
+			wantNodes: idSet("n1", "n2", "n3"),
+			wantEdges: idSet("e1"),
+		},
+		{
+			name:      "since the latest revision returns nothing",
+			since:     revAfterN3,
+			wantNodes: idSet(),
+			wantEdges: idSet(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g.RLock()
+			elements := g.ElementsSince(tt.since)
+			g.RUnlock()
+
+			if got := nodeIDs(elements.Nodes); !mapsEqual(got, tt.wantNodes) {
+				t.Errorf("nodes: got %v, want %v", got, tt.wantNodes)
+			}
+			if got := edgeIDs(elements.Edges); !mapsEqual(got, tt.wantEdges) {
+				t.Errorf("edges: got %v, want %v", got, tt.wantEdges)
+			}
+		})
+	}
+}
+
+func TestElementsSinceReflectsDeletions(t *testing.T) {
+	g := NewGraph()
+
+	n1 := &Node{ID: "n1"}
+	g.AddNode(n1)
+	n2 := &Node{ID: "n2"}
+	g.AddNode(n2)
+	watermark := n2.Revision
+
+	g.DelNode(n1)
+
+	g.RLock()
+	elements := g.ElementsSince(watermark)
+	g.RUnlock()
+
+	if got := nodeIDs(elements.Nodes); len(got) != 0 {
+		t.Fatalf("expected the deleted node to be absent from ElementsSince, got %v", got)
+	}
+}
+
+func mapsEqual(a, b map[Identifier]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
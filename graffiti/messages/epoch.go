@@ -0,0 +1,30 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package messages
+
+// EpochSyncMsgType is the fan-out catch-up handshake sent to a newly
+// elected master: since it was already mirrored every event, it only needs
+// the current epoch to start accepting live updates again, rather than a
+// full or partial re-sync.
+const EpochSyncMsgType MessageType = "EpochSyncMessage"
+
+// EpochSyncMsg tells a newly elected master the fan-out epoch it should
+// start accepting mirrored events at.
+type EpochSyncMsg struct {
+	Epoch uint64
+}
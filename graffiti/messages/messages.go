@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package messages defines the structured messages exchanged over the
+// websocket connection between an agent's Forwarder and an analyzer.
+package messages
+
+import (
+	"time"
+
+	"github.com/skydive-project/skydive/graffiti/graph"
+)
+
+// MessageType identifies the kind of a StructMessage.
+type MessageType string
+
+// Message kinds exchanged between a Forwarder and its master(s).
+const (
+	// SyncMsgType carries a full graph snapshot.
+	SyncMsgType MessageType = "SyncMessage"
+
+	NodeAddedMsgType            MessageType = "NodeAdded"
+	NodeUpdatedMsgType          MessageType = "NodeUpdated"
+	NodePartiallyUpdatedMsgType MessageType = "NodePartiallyUpdated"
+	NodeDeletedMsgType          MessageType = "NodeDeleted"
+
+	EdgeAddedMsgType            MessageType = "EdgeAdded"
+	EdgeUpdatedMsgType          MessageType = "EdgeUpdated"
+	EdgePartiallyUpdatedMsgType MessageType = "EdgePartiallyUpdated"
+	EdgeDeletedMsgType          MessageType = "EdgeDeleted"
+
+	// LeadershipTransferMsgType carries the identity of the speaker a
+	// draining master wants agents to migrate to.
+	LeadershipTransferMsgType MessageType = "LeadershipTransfer"
+)
+
+// StructMessage is the envelope every message exchanged between a
+// Forwarder and a master is wrapped in.
+type StructMessage struct {
+	Kind MessageType
+	Obj  interface{}
+	// Epoch is the fan-out epoch the message was sent under. It is only
+	// meaningful in ModeFanOut, where it lets a newly elected master tell
+	// apart live mirrored events from before and after its own election.
+	Epoch uint64
+}
+
+// NewStructMessage wraps obj into a StructMessage of the given kind.
+func NewStructMessage(kind MessageType, obj interface{}) *StructMessage {
+	return &StructMessage{Kind: kind, Obj: obj}
+}
+
+// SyncMsg carries a full graph snapshot, sent on the first re-sync with a
+// given master identity.
+type SyncMsg struct {
+	Elements graph.Elements
+}
+
+// PartiallyUpdatedMsg carries a field-level update to a single node or
+// edge, instead of shipping its whole metadata again.
+type PartiallyUpdatedMsg struct {
+	ID        graph.Identifier
+	UpdatedAt time.Time
+	Revision  int64
+	Ops       []graph.PartiallyUpdatedOp
+}
+
+// LeadershipTransferMsg is broadcast by a draining master to announce the
+// peer agents should fail over to, ahead of disappearing.
+type LeadershipTransferMsg struct {
+	TargetID string
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package messages
+
+import "github.com/skydive-project/skydive/graffiti/graph"
+
+const (
+	// PartialSyncMsgType carries only the elements changed since the last
+	// acknowledged re-sync, plus the tombstones of what was deleted since
+	// then, instead of the whole graph.
+	PartialSyncMsgType MessageType = "PartialSyncMessage"
+	// SyncAckMsgType acknowledges a (partial or full) re-sync.
+	SyncAckMsgType MessageType = "SyncAckMessage"
+)
+
+// PartialSyncMsg carries the elements changed since the requesting agent's
+// last acknowledged revision, along with the IDs tombstoned (deleted) since
+// then, so the master can bring its copy of the graph up to date without a
+// full re-sync.
+type PartialSyncMsg struct {
+	Elements   graph.Elements
+	Tombstones []graph.Identifier
+}
+
+// SyncAckMsg acknowledges a (partial or full) re-sync. HighWatermark is the
+// highest Revision the master has recorded after applying the sync; a
+// negative value means the master couldn't use it (new analyzer, compacted
+// state, schema change) and the sender should fall back to a full re-sync.
+type SyncAckMsg struct {
+	HighWatermark int64
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package websocket
+
+import "github.com/skydive-project/skydive/graffiti/etcd/client"
+
+// ElectionBridge adapts the outcome of an etcd-backed client.MasterElection
+// into a websocket MasterElection: whichever analyzer process wins (or
+// loses) the etcd election becomes (or stops being) the master that
+// connected agents' Forwarders re-sync against. Without it the two
+// elections run side by side with no relation to each other.
+type ElectionBridge struct {
+	election *MasterElection
+	self     Speaker
+}
+
+// NewElectionBridge creates a bridge reporting self as the master of
+// election whenever the etcd-backed election this bridge is registered on
+// (via client.MasterElection.AddEventListener) starts or switches to being
+// master, and clearing it on starting or switching to being a slave.
+func NewElectionBridge(election *MasterElection, self Speaker) *ElectionBridge {
+	return &ElectionBridge{election: election, self: self}
+}
+
+// OnStartAsMaster implements client.MasterElectionListener.
+func (b *ElectionBridge) OnStartAsMaster() {
+	b.election.SetMaster(b.self)
+}
+
+// OnStartAsSlave implements client.MasterElectionListener.
+func (b *ElectionBridge) OnStartAsSlave() {
+	b.election.SetMaster(nil)
+}
+
+// OnSwitchToMaster implements client.MasterElectionListener.
+func (b *ElectionBridge) OnSwitchToMaster() {
+	b.election.SetMaster(b.self)
+}
+
+// OnSwitchToSlave implements client.MasterElectionListener.
+func (b *ElectionBridge) OnSwitchToSlave() {
+	b.election.SetMaster(nil)
+}
+
+// OnUnhealthy implements client.MasterElectionListener and leaves the
+// bridged master untouched. The session rebuild that comes with it
+// already reports this analyzer as a slave, through OnSwitchToSlave (if it
+// was master) and OnStartAsSlave, which clear the bridged master; a later
+// OnSwitchToMaster installs self again once it wins the new election.
+func (b *ElectionBridge) OnUnhealthy() {}
+
+// OnRecovered implements client.MasterElectionListener; see OnUnhealthy.
+func (b *ElectionBridge) OnRecovered() {}
+
+var _ client.MasterElectionListener = (*ElectionBridge)(nil)
@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package websocket provides the Speaker/pool abstractions the Forwarder
+// forwards topology events through, and the MasterElection helper that
+// tracks the current master of a pool and dispatches the control messages
+// (leadership transfer, re-sync acknowledgements) a Forwarder reacts to.
+package websocket
+
+import (
+	"sync"
+
+	"github.com/skydive-project/skydive/graffiti/messages"
+)
+
+// Speaker is a single websocket peer, either side of an agent/analyzer
+// connection.
+type Speaker interface {
+	GetAddrPort() (string, int)
+	SendMessage(msg *messages.StructMessage)
+}
+
+// SpeakerEventHandler is notified when a speaker joins or leaves a
+// StructSpeakerPool.
+type SpeakerEventHandler interface {
+	OnConnected(c Speaker)
+	OnDisconnected(c Speaker)
+}
+
+// StructMessageHandler is notified of every StructMessage received from any
+// speaker of a StructSpeakerPool.
+type StructMessageHandler interface {
+	OnStructMessage(c Speaker, msg *messages.StructMessage)
+}
+
+// StructSpeakerPool is the set of websocket peers a Forwarder can forward
+// topology events to.
+type StructSpeakerPool interface {
+	AddEventHandler(handler SpeakerEventHandler)
+	AddStructMessageHandler(handler StructMessageHandler)
+	GetSpeakers() []Speaker
+	GetSpeakerByID(id string) Speaker
+}
+
+// MasterElectionHandler is notified when the master tracked by a
+// MasterElection changes. A nil Speaker means the master was lost.
+type MasterElectionHandler interface {
+	OnNewMaster(c Speaker)
+}
+
+// LeadershipTransferListener is notified when the current master announces,
+// ahead of disappearing, the speaker agents should migrate to.
+type LeadershipTransferListener interface {
+	OnLeadershipTransfer(targetID string)
+}
+
+// SyncAckListener is notified when a master acknowledges a (partial or
+// full) re-sync.
+type SyncAckListener interface {
+	OnSyncAck(c Speaker, ack *messages.SyncAckMsg)
+}
+
+// MasterElection tracks the speaker currently acting as master for a
+// StructSpeakerPool, and dispatches the StructMessages it receives from the
+// pool to whichever registered handlers implement the matching narrow
+// interface (LeadershipTransferListener, SyncAckListener, ...).
+type MasterElection struct {
+	pool StructSpeakerPool
+
+	mu       sync.RWMutex
+	master   Speaker
+	handlers []interface{}
+}
+
+// NewMasterElection creates a MasterElection tracking the given pool. It
+// registers itself as both the pool's SpeakerEventHandler, so it can pick
+// an initial master as speakers connect and clear it when that master
+// disconnects, and its StructMessageHandler, so it can dispatch incoming
+// control messages to the handlers added through AddEventHandler.
+func NewMasterElection(pool StructSpeakerPool) *MasterElection {
+	e := &MasterElection{pool: pool}
+	pool.AddEventHandler(e)
+	pool.AddStructMessageHandler(e)
+	return e
+}
+
+// AddEventHandler registers a handler to be notified, through OnNewMaster,
+// of master changes. A handler that also implements LeadershipTransferListener
+// or SyncAckListener is notified of those control messages too.
+func (e *MasterElection) AddEventHandler(handler MasterElectionHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers = append(e.handlers, handler)
+}
+
+// GetMaster returns the currently elected master, or nil if none is
+// connected.
+func (e *MasterElection) GetMaster() Speaker {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.master
+}
+
+// SendMessageToMaster sends msg to the current master, if any.
+func (e *MasterElection) SendMessageToMaster(msg *messages.StructMessage) {
+	if master := e.GetMaster(); master != nil {
+		master.SendMessage(msg)
+	}
+}
+
+// ConnectTo makes the speaker identified by targetID the new master right
+// away, without waiting for a fresh election to complete. It is used by a
+// Forwarder to fail over directly to the target announced through a
+// LeadershipTransferMsg.
+func (e *MasterElection) ConnectTo(targetID string) bool {
+	speaker := e.pool.GetSpeakerByID(targetID)
+	if speaker == nil {
+		return false
+	}
+	e.setMaster(speaker)
+	return true
+}
+
+// TransferLeadership announces to every speaker of the pool that targetID is
+// taking over as master. A draining master calls this ahead of
+// disappearing, so that agents fail over to targetID directly instead of
+// waiting out a fresh election.
+func (e *MasterElection) TransferLeadership(targetID string) {
+	msg := messages.NewStructMessage(messages.LeadershipTransferMsgType, &messages.LeadershipTransferMsg{TargetID: targetID})
+	for _, speaker := range e.pool.GetSpeakers() {
+		speaker.SendMessage(msg)
+	}
+}
+
+func (e *MasterElection) setMaster(speaker Speaker) {
+	e.mu.Lock()
+	e.master = speaker
+	handlers := append([]interface{}(nil), e.handlers...)
+	e.mu.Unlock()
+
+	for _, h := range handlers {
+		if handler, ok := h.(MasterElectionHandler); ok {
+			handler.OnNewMaster(speaker)
+		}
+	}
+}
+
+// SetMaster installs c as the current master and notifies registered
+// handlers through OnNewMaster, exactly as ConnectTo/OnConnected do. It is
+// exported so that whatever owns both this MasterElection and a
+// client.MasterElector (the etcd-backed election deciding which analyzer
+// is master) can bridge the two: call SetMaster(self) from
+// client.MasterElectionListener's OnStartAsMaster/OnSwitchToMaster, and
+// SetMaster(nil) from OnStartAsSlave/OnSwitchToSlave. See ElectionBridge.
+func (e *MasterElection) SetMaster(c Speaker) {
+	e.setMaster(c)
+}
+
+// OnConnected implements SpeakerEventHandler. On a cold start, with no
+// etcd-backed election result having come in yet (see SetMaster), the
+// first speaker to connect is taken as the master, so that a Forwarder
+// always has someone to re-sync against instead of waiting forever; a
+// later SetMaster/ConnectTo call overrides this first guess.
+func (e *MasterElection) OnConnected(c Speaker) {
+	e.mu.Lock()
+	if e.master != nil {
+		e.mu.Unlock()
+		return
+	}
+	e.master = c
+	handlers := append([]interface{}(nil), e.handlers...)
+	e.mu.Unlock()
+
+	for _, h := range handlers {
+		if handler, ok := h.(MasterElectionHandler); ok {
+			handler.OnNewMaster(c)
+		}
+	}
+}
+
+// OnDisconnected implements SpeakerEventHandler: if the disconnecting
+// speaker was the master, it clears it and notifies handlers with a nil
+// Speaker so they can buffer/fail over.
+func (e *MasterElection) OnDisconnected(c Speaker) {
+	e.mu.Lock()
+	if e.master != c {
+		e.mu.Unlock()
+		return
+	}
+	e.master = nil
+	handlers := append([]interface{}(nil), e.handlers...)
+	e.mu.Unlock()
+
+	for _, h := range handlers {
+		if handler, ok := h.(MasterElectionHandler); ok {
+			handler.OnNewMaster(nil)
+		}
+	}
+}
+
+// OnStructMessage implements StructMessageHandler, dispatching messages
+// received from the pool to whichever registered handlers implement the
+// matching narrow interface.
+func (e *MasterElection) OnStructMessage(c Speaker, msg *messages.StructMessage) {
+	e.mu.RLock()
+	handlers := append([]interface{}(nil), e.handlers...)
+	e.mu.RUnlock()
+
+	switch msg.Kind {
+	case messages.LeadershipTransferMsgType:
+		transfer, ok := msg.Obj.(*messages.LeadershipTransferMsg)
+		if !ok {
+			return
+		}
+		for _, h := range handlers {
+			if listener, ok := h.(LeadershipTransferListener); ok {
+				listener.OnLeadershipTransfer(transfer.TargetID)
+			}
+		}
+	case messages.SyncAckMsgType:
+		ack, ok := msg.Obj.(*messages.SyncAckMsg)
+		if !ok {
+			return
+		}
+		for _, h := range handlers {
+			if listener, ok := h.(SyncAckListener); ok {
+				listener.OnSyncAck(c, ack)
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2016 Red Hat, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy ofthe License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specificlanguage governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package websocket
+
+import (
+	"testing"
+
+	"github.com/skydive-project/skydive/graffiti/messages"
+)
+
+type fakeSpeaker struct {
+	addr string
+	port int
+	sent []*messages.StructMessage
+}
+
+func (s *fakeSpeaker) GetAddrPort() (string, int) { return s.addr, s.port }
+func (s *fakeSpeaker) SendMessage(msg *messages.StructMessage) {
+	s.sent = append(s.sent, msg)
+}
+
+type fakePool struct {
+	speakers     []Speaker
+	eventHandler SpeakerEventHandler
+}
+
+func (p *fakePool) AddEventHandler(handler SpeakerEventHandler)          { p.eventHandler = handler }
+func (p *fakePool) AddStructMessageHandler(handler StructMessageHandler) {}
+func (p *fakePool) GetSpeakers() []Speaker                               { return p.speakers }
+func (p *fakePool) GetSpeakerByID(id string) Speaker {
+	for _, s := range p.speakers {
+		if addr, port := s.GetAddrPort(); addr == id {
+			_ = port
+			return s
+		}
+	}
+	return nil
+}
+
+func TestOnConnectedPicksFirstSpeakerAsMasterOnColdStart(t *testing.T) {
+	pool := &fakePool{}
+	election := NewMasterElection(pool)
+
+	first := &fakeSpeaker{addr: "first"}
+	second := &fakeSpeaker{addr: "second"}
+
+	pool.eventHandler.OnConnected(first)
+	pool.eventHandler.OnConnected(second)
+
+	if got := election.GetMaster(); got != first {
+		t.Fatalf("expected the first connected speaker to become master, got %v", got)
+	}
+}
+
+func TestSetMasterOverridesColdStartGuess(t *testing.T) {
+	pool := &fakePool{}
+	election := NewMasterElection(pool)
+
+	first := &fakeSpeaker{addr: "first"}
+	pool.eventHandler.OnConnected(first)
+
+	elected := &fakeSpeaker{addr: "elected"}
+	election.SetMaster(elected)
+
+	if got := election.GetMaster(); got != elected {
+		t.Fatalf("expected SetMaster to override the cold-start guess, got %v", got)
+	}
+}
+
+func TestElectionBridgeTracksEtcdElectionOutcome(t *testing.T) {
+	pool := &fakePool{}
+	election := NewMasterElection(pool)
+	self := &fakeSpeaker{addr: "self"}
+
+	bridge := NewElectionBridge(election, self)
+
+	bridge.OnStartAsMaster()
+	if got := election.GetMaster(); got != self {
+		t.Fatalf("expected OnStartAsMaster to install self as master, got %v", got)
+	}
+
+	bridge.OnSwitchToSlave()
+	if got := election.GetMaster(); got != nil {
+		t.Fatalf("expected OnSwitchToSlave to clear the master, got %v", got)
+	}
+
+	bridge.OnSwitchToMaster()
+	if got := election.GetMaster(); got != self {
+		t.Fatalf("expected OnSwitchToMaster to install self as master again, got %v", got)
+	}
+}